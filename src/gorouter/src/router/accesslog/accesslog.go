@@ -0,0 +1,136 @@
+// Package accesslog records one line per proxied request (start time,
+// request line, status, bytes, app id/index and response time; not the
+// common log format), and optionally forwards the same records to
+// Loggregator so operators can tail access logs without shelling onto a
+// router instance.
+package accesslog
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	steno "github.com/cloudfoundry/gosteno"
+	emitter "github.com/cloudfoundry/loggregatorlib/emitter"
+
+	"router/config"
+)
+
+// channelBufferSize bounds how many records can be queued for the writer
+// goroutine before Log starts dropping them, so a slow disk or Loggregator
+// endpoint never blocks request handling.
+const channelBufferSize = 128
+
+// Record captures everything the proxy knows about a single request once
+// the response has been written.
+type Record struct {
+	StartTime    time.Time
+	RequestLine  string
+	StatusCode   int
+	BytesSent    int
+	AppId        string
+	AppIndex     int
+	ResponseTime time.Duration
+}
+
+func (r *Record) WriteTo(w *bytes.Buffer) {
+	fmt.Fprintf(w, "%s [%s] %d %d app_id:%s app_index:%d response_time:%.6f\n",
+		r.StartTime.Format(time.RFC1123Z),
+		r.RequestLine,
+		r.StatusCode,
+		r.BytesSent,
+		r.AppId,
+		r.AppIndex,
+		r.ResponseTime.Seconds(),
+	)
+}
+
+// AccessLogger consumes Records off a buffered channel and writes them to a
+// local file and/or Loggregator, so request handling never blocks on that
+// I/O.
+type AccessLogger struct {
+	channel chan Record
+	done    chan struct{}
+
+	file        *os.File
+	emitter     emitter.Emitter
+	routerIndex int
+}
+
+// NewFileAndLoggregatorAccessLogger opens config.AccessLog (if set) and
+// dials Loggregator (if config.LoggregatorUrl/SharedSecret are set). Either
+// destination may be disabled independently; having neither configured
+// yields a logger that simply discards records.
+func NewFileAndLoggregatorAccessLogger(c *config.Config, routerIndex int) (*AccessLogger, error) {
+	a := &AccessLogger{
+		channel:     make(chan Record, channelBufferSize),
+		done:        make(chan struct{}),
+		routerIndex: routerIndex,
+	}
+
+	if c.AccessLog != "" {
+		file, err := os.OpenFile(c.AccessLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		a.file = file
+	}
+
+	if c.LoggregatorUrl != "" {
+		e, err := emitter.NewEmitter(c.LoggregatorUrl, "RTR", strconv.Itoa(routerIndex), c.LoggregatorSharedSecret, steno.NewLogger("accesslog.emitter"))
+		if err != nil {
+			return nil, err
+		}
+		a.emitter = e
+	}
+
+	return a, nil
+}
+
+// Log enqueues a record for the writer goroutine. It never blocks; if the
+// channel is full the record is dropped.
+func (a *AccessLogger) Log(r Record) {
+	select {
+	case a.channel <- r:
+	default:
+	}
+}
+
+// Start begins consuming queued records in a background goroutine.
+func (a *AccessLogger) Start() {
+	go a.run()
+}
+
+// Stop drains no further records and closes the underlying file, if any.
+func (a *AccessLogger) Stop() {
+	close(a.done)
+}
+
+func (a *AccessLogger) run() {
+	for {
+		select {
+		case r := <-a.channel:
+			a.write(&r)
+		case <-a.done:
+			if a.file != nil {
+				a.file.Close()
+			}
+			return
+		}
+	}
+}
+
+func (a *AccessLogger) write(r *Record) {
+	var buf bytes.Buffer
+	r.WriteTo(&buf)
+
+	if a.file != nil {
+		a.file.Write(buf.Bytes())
+	}
+
+	if a.emitter != nil {
+		a.emitter.Emit(r.AppId, buf.String())
+	}
+}
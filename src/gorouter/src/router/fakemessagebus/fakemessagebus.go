@@ -0,0 +1,86 @@
+// Package fakemessagebus is an in-process stand-in for router.MessageBus,
+// analogous to fakeyagnats, so router tests can drive
+// SubscribeRegister/SubscribeUnregister/flushApps without a real NATS
+// server.
+package fakemessagebus
+
+type subscription struct {
+	callback func([]byte)
+}
+
+type FakeMessageBus struct {
+	Published     map[string][][]byte
+	subscriptions map[string][]subscription
+	responders    map[string]func([]byte) []byte
+	pingResult    bool
+	onConnect     func()
+	onReconnect   func()
+	onClosed      func()
+}
+
+func NewFakeMessageBus() *FakeMessageBus {
+	return &FakeMessageBus{
+		Published:     make(map[string][][]byte),
+		subscriptions: make(map[string][]subscription),
+		responders:    make(map[string]func([]byte) []byte),
+		pingResult:    true,
+	}
+}
+
+func (f *FakeMessageBus) Connect() error                    { return nil }
+func (f *FakeMessageBus) ConfigureCluster(servers []string) {}
+func (f *FakeMessageBus) Ping() bool                        { return f.pingResult }
+func (f *FakeMessageBus) SetPingResult(result bool)         { f.pingResult = result }
+
+func (f *FakeMessageBus) OnConnect(callback func())   { f.onConnect = callback }
+func (f *FakeMessageBus) OnReconnect(callback func()) { f.onReconnect = callback }
+func (f *FakeMessageBus) OnClosed(callback func())    { f.onClosed = callback }
+
+func (f *FakeMessageBus) Publish(subject string, payload []byte) error {
+	f.Published[subject] = append(f.Published[subject], payload)
+	return nil
+}
+
+func (f *FakeMessageBus) Subscribe(subject string, callback func([]byte)) error {
+	f.subscriptions[subject] = append(f.subscriptions[subject], subscription{callback: callback})
+	return nil
+}
+
+func (f *FakeMessageBus) RespondToChannel(subject string, callback func([]byte) []byte) error {
+	f.responders[subject] = callback
+	return nil
+}
+
+// PublishToSubscribers delivers payload to every callback registered via
+// Subscribe for subject, as a real bus would.
+func (f *FakeMessageBus) PublishToSubscribers(subject string, payload []byte) {
+	for _, s := range f.subscriptions[subject] {
+		s.callback(payload)
+	}
+}
+
+// Request simulates a NATS request/reply round trip against a previously
+// registered RespondToChannel responder. It returns nil if nothing ever
+// responded to subject, rather than panicking on a nil callback.
+func (f *FakeMessageBus) Request(subject string, payload []byte) []byte {
+	responder, ok := f.responders[subject]
+	if !ok {
+		return nil
+	}
+
+	return responder(payload)
+}
+
+// Reconnect simulates the bus dropping and re-establishing its connection.
+func (f *FakeMessageBus) Reconnect() {
+	if f.onReconnect != nil {
+		f.onReconnect()
+	}
+}
+
+// Close simulates the bus connection being closed for good.
+func (f *FakeMessageBus) Close() {
+	if f.onClosed != nil {
+		f.onClosed()
+	}
+}
@@ -0,0 +1,199 @@
+package router
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	mbus "github.com/cloudfoundry/go_cfmessagebus"
+
+	"router/config"
+)
+
+// MessageBus is the narrow surface Router needs from a message bus backend.
+// Keeping it narrow lets SubscribeRegister, SubscribeUnregister and
+// flushApps be unit-tested against router/fakemessagebus instead of a real
+// NATS server, and lets deployers swap in a different broker by picking a
+// different config.MessageBus.Type rather than forking the router.
+type MessageBus interface {
+	Connect() error
+	ConfigureCluster(servers []string)
+	Publish(subject string, payload []byte) error
+	Subscribe(subject string, callback func([]byte)) error
+	RespondToChannel(subject string, callback func([]byte) []byte) error
+	Ping() bool
+	OnConnect(callback func())
+	OnReconnect(callback func())
+	OnClosed(callback func())
+}
+
+// NewMessageBus selects a MessageBus backend based on config.MessageBus.Type,
+// defaulting to NATS when unset so existing deployments keep working
+// unchanged.
+func NewMessageBus(c *config.Config) (MessageBus, error) {
+	switch c.MessageBus.Type {
+	case "", "nats":
+		return newNatsMessageBus(c)
+	case "http":
+		return newHTTPMessageBus(c.MessageBus.HTTP), nil
+	default:
+		return nil, fmt.Errorf("unknown message bus type: %s", c.MessageBus.Type)
+	}
+}
+
+// natsPingInterval is how often natsMessageBus checks connection health
+// once connected, so it can detect a reconnect or a close.
+const natsPingInterval = 1 * time.Second
+
+// natsMessageBus adapts the go_cfmessagebus NATS client to MessageBus.
+// go_cfmessagebus only exposes Configure/Connect/Publish/Subscribe/Ping for
+// a single server; it has no notion of a server cluster or of
+// connect/reconnect/close callbacks. natsMessageBus builds all of that on
+// top of those primitives: ConfigureCluster just remembers the candidate
+// servers, and a poll loop drives OnReconnect/OnClosed by noticing when
+// Ping starts failing and re-dialing the configured servers in order,
+// starting again from the first one.
+type natsMessageBus struct {
+	user string
+	pass string
+
+	mu      sync.Mutex
+	servers []string
+	client  mbus.CFMessageBus
+
+	onConnect   func()
+	onReconnect func()
+	onClosed    func()
+
+	stop chan struct{}
+}
+
+func newNatsMessageBus(c *config.Config) (MessageBus, error) {
+	client, err := mbus.NewCFMessageBus("NATS")
+	if err != nil {
+		return nil, err
+	}
+
+	return &natsMessageBus{
+		client: client,
+		user:   c.Nats.User,
+		pass:   c.Nats.Pass,
+	}, nil
+}
+
+func (n *natsMessageBus) ConfigureCluster(servers []string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.servers = servers
+}
+
+func (n *natsMessageBus) OnConnect(callback func())   { n.onConnect = callback }
+func (n *natsMessageBus) OnReconnect(callback func()) { n.onReconnect = callback }
+func (n *natsMessageBus) OnClosed(callback func())    { n.onClosed = callback }
+
+func (n *natsMessageBus) Ping() bool { return n.client.Ping() }
+
+func (n *natsMessageBus) Publish(subject string, payload []byte) error {
+	return n.client.Publish(subject, payload)
+}
+
+func (n *natsMessageBus) Subscribe(subject string, callback func([]byte)) error {
+	return n.client.Subscribe(subject, callback)
+}
+
+func (n *natsMessageBus) RespondToChannel(subject string, callback func([]byte) []byte) error {
+	return n.client.RespondToChannel(subject, callback)
+}
+
+// Connect dials the first reachable server in the configured cluster and,
+// once connected, starts the poll loop that watches for a reconnect or a
+// close.
+func (n *natsMessageBus) Connect() error {
+	if err := n.dialNextServer(); err != nil {
+		return err
+	}
+
+	if n.onConnect != nil {
+		n.onConnect()
+	}
+
+	n.stop = make(chan struct{})
+	go n.pollConnection()
+
+	return nil
+}
+
+func (n *natsMessageBus) dialNextServer() error {
+	n.mu.Lock()
+	servers := n.servers
+	n.mu.Unlock()
+
+	var lastErr error
+	for _, server := range servers {
+		host, portString, err := net.SplitHostPort(server)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		port, err := strconv.Atoi(portString)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		n.client.Configure(host, port, n.user, n.pass)
+
+		if err := n.client.Connect(); err != nil {
+			lastErr = err
+			continue
+		}
+
+		return nil
+	}
+
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no NATS servers configured")
+	}
+
+	return lastErr
+}
+
+func (n *natsMessageBus) pollConnection() {
+	ticker := time.NewTicker(natsPingInterval)
+	defer ticker.Stop()
+
+	up := true
+
+	for {
+		select {
+		case <-ticker.C:
+			if n.client.Ping() {
+				up = true
+				continue
+			}
+
+			if !up {
+				continue
+			}
+			up = false
+
+			if err := n.dialNextServer(); err == nil {
+				up = true
+				if n.onReconnect != nil {
+					n.onReconnect()
+				}
+				continue
+			}
+
+			if n.onClosed != nil {
+				n.onClosed()
+			}
+			return
+		case <-n.stop:
+			return
+		}
+	}
+}
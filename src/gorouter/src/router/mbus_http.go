@@ -0,0 +1,51 @@
+package router
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+
+	"router/config"
+)
+
+// httpMessageBus is a starting point for brokers that speak plain HTTP
+// pubsub instead of NATS: Publish works today by POSTing to the broker,
+// while Subscribe/RespondToChannel (which need a push or long-poll channel
+// back from the broker) are left unimplemented until a concrete broker is
+// chosen.
+type httpMessageBus struct {
+	client *http.Client
+	url    string
+}
+
+func newHTTPMessageBus(c config.HTTPMessageBus) MessageBus {
+	return &httpMessageBus{
+		client: &http.Client{},
+		url:    c.URL,
+	}
+}
+
+func (h *httpMessageBus) Connect() error                    { return nil }
+func (h *httpMessageBus) ConfigureCluster(servers []string) {}
+func (h *httpMessageBus) Ping() bool                        { return true }
+func (h *httpMessageBus) OnConnect(callback func())         {}
+func (h *httpMessageBus) OnReconnect(callback func())       {}
+func (h *httpMessageBus) OnClosed(callback func())          {}
+
+func (h *httpMessageBus) Publish(subject string, payload []byte) error {
+	resp, err := h.client.Post(h.url+"/"+subject, "application/octet-stream", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+func (h *httpMessageBus) Subscribe(subject string, callback func([]byte)) error {
+	return fmt.Errorf("http message bus does not support Subscribe yet")
+}
+
+func (h *httpMessageBus) RespondToChannel(subject string, callback func([]byte) []byte) error {
+	return fmt.Errorf("http message bus does not support RespondToChannel yet")
+}
@@ -0,0 +1,93 @@
+package router
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+
+	"router/accesslog"
+	"router/config"
+)
+
+// Proxy is the router's http.Handler. It looks up a backend for the
+// incoming request's Host header in the registry, reverse-proxies the
+// request to it, and records an access log line once the response has been
+// written.
+type Proxy struct {
+	config       *config.Config
+	registry     *Registry
+	varz         Varz
+	accessLogger *accesslog.AccessLogger
+}
+
+func NewProxy(c *config.Config, registry *Registry, varz Varz, accessLogger *accesslog.AccessLogger) *Proxy {
+	return &Proxy{
+		config:       c,
+		registry:     registry,
+		varz:         varz,
+		accessLogger: accessLogger,
+	}
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+
+	backend, ok := p.registry.Lookup(req.Host)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// These are per-route, driven by the route's own registration, rather
+	// than a listener-wide switch: two routes on the same router can
+	// disagree about whether to force SSL or require a client cert.
+	if req.TLS == nil && p.config.EnableSSL && backend.Tags["ssl_redirect"] == "true" {
+		target := "https://" + req.Host + req.URL.RequestURI()
+		http.Redirect(w, req, target, http.StatusMovedPermanently)
+		return
+	}
+
+	if backend.Tags["client_cert_required"] == "true" {
+		if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+			http.Error(w, "client certificate required", http.StatusForbidden)
+			return
+		}
+	}
+
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+	target := &url.URL{Scheme: "http", Host: fmt.Sprintf("%s:%d", backend.Host, backend.Port)}
+	httputil.NewSingleHostReverseProxy(target).ServeHTTP(recorder, req)
+
+	p.accessLogger.Log(accesslog.Record{
+		StartTime:    start,
+		RequestLine:  fmt.Sprintf("%s %s %s", req.Method, req.URL.RequestURI(), req.Proto),
+		StatusCode:   recorder.status,
+		BytesSent:    recorder.bytes,
+		AppId:        backend.App,
+		AppIndex:     backend.Index,
+		ResponseTime: time.Since(start),
+	})
+}
+
+// statusRecorder wraps a ResponseWriter so ServeHTTP can learn the status
+// code and byte count a reverse-proxied response actually produced, for the
+// access log record.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += n
+	return n, err
+}
@@ -3,11 +3,15 @@ package router
 import (
 	"bytes"
 	"compress/zlib"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
-	mbus "github.com/cloudfoundry/go_cfmessagebus"
 	steno "github.com/cloudfoundry/gosteno"
+	"io/ioutil"
 	"net"
+	"os"
+	"router/accesslog"
 	vcap "router/common"
 	"router/config"
 	"router/proxy"
@@ -17,17 +21,36 @@ import (
 )
 
 type Router struct {
-	config     *config.Config
-	proxy      *Proxy
-	mbusClient mbus.CFMessageBus
-	registry   *Registry
-	varz       Varz
-	component  *vcap.VcapComponent
+	config       *config.Config
+	proxy        *Proxy
+	mbusClient   MessageBus
+	registry     *Registry
+	varz         Varz
+	component    *vcap.VcapComponent
+	accessLogger *accesslog.AccessLogger
+
+	// id identifies this router instance on router.start messages. It is
+	// generated once so that every periodic announcement and every
+	// re-announcement after a reconnect carries the same identity; peers
+	// track routers by this id and would otherwise see a new router appear
+	// on every tick.
+	id string
+
+	// listener/sslListener are recorded by Run so Shutdown can close them
+	// when the mbus connection is closed for good, instead of leaving the
+	// router serving stale routes with no way to reach it over NATS.
+	listener    net.Listener
+	sslListener net.Listener
 }
 
+// exitFunc is os.Exit by default; tests swap it out so Shutdown can be
+// exercised without killing the test binary.
+var exitFunc = os.Exit
+
 func NewRouter(c *config.Config) *Router {
 	router := &Router{
 		config: c,
+		id:     vcap.GenerateUUID(),
 	}
 
 	// setup number of procs
@@ -42,8 +65,14 @@ func NewRouter(c *config.Config) *Router {
 		return !router.mbusClient.Ping()
 	}
 
+	accessLogger, err := accesslog.NewFileAndLoggregatorAccessLogger(router.config, router.config.Index)
+	if err != nil {
+		log.Fatalf("Error creating access logger: %s", err.Error())
+	}
+	router.accessLogger = accessLogger
+
 	router.varz = NewVarz(router.registry)
-	router.proxy = NewProxy(router.config, router.registry, router.varz)
+	router.proxy = NewProxy(router.config, router.registry, router.varz, router.accessLogger)
 
 	var host string
 	if router.config.Status.Port != 0 {
@@ -117,6 +146,64 @@ func (r *Router) SubscribeUnregister() {
 	})
 }
 
+// greetMessage is sent in reply to a router.greet request so that DEAs and
+// apps can learn this router's expected register cadence at boot instead of
+// hard-coding it.
+type greetMessage struct {
+	MinimumRegisterIntervalInSeconds int `json:"minimumRegisterIntervalInSeconds"`
+	PruneThresholdInSeconds          int `json:"pruneThresholdInSeconds"`
+}
+
+func (r *Router) greetMessage() ([]byte, error) {
+	return json.Marshal(greetMessage{
+		MinimumRegisterIntervalInSeconds: int(r.config.PublishStartMessageInterval.Seconds()),
+		PruneThresholdInSeconds:          int(r.config.DropletStaleThreshold.Seconds()),
+	})
+}
+
+// HandleGreetings responds to router.greet requests with this router's
+// minimum register interval and prune threshold, mirroring the greet
+// handshake used by newer gorouter clients.
+func (r *Router) HandleGreetings() {
+	err := r.mbusClient.RespondToChannel("router.greet", func(_ []byte) []byte {
+		response, err := r.greetMessage()
+		if err != nil {
+			log.Errorf("Error marshalling router.greet response: %s", err.Error())
+			return nil
+		}
+
+		return response
+	})
+	if err != nil {
+		log.Errorf("Error subscribing to router.greet: %s", err.Error())
+	}
+}
+
+// SubscribeToRouterStart listens for other routers' router.start
+// announcements and adopts their advertised register interval, so a new
+// router joining a cluster prunes on the same cadence as its peers rather
+// than on its own hard-coded default.
+func (r *Router) SubscribeToRouterStart() {
+	callback := func(payload []byte) {
+		var msg routerStartMessage
+
+		err := json.Unmarshal(payload, &msg)
+		if err != nil {
+			log.Warnf("router.start: Error unmarshalling JSON: %s", err.Error())
+			return
+		}
+
+		if msg.MinimumRegisterIntervalInSeconds > 0 {
+			r.registry.SetPruneStaleDropletsInterval(time.Duration(msg.MinimumRegisterIntervalInSeconds) * time.Second)
+		}
+	}
+
+	err := r.mbusClient.Subscribe("router.start", callback)
+	if err != nil {
+		log.Errorf("Error subscribing to router.start: %s", err.Error())
+	}
+}
+
 func (r *Router) flushApps(t time.Time) {
 	x := r.registry.ActiveSince(t)
 
@@ -158,20 +245,53 @@ func (r *Router) ScheduleFlushApps() {
 	}()
 }
 
-func (r *Router) SendStartMessage() {
+// routerStartMessage is published on router.start to announce this router,
+// and is the same struct SubscribeToRouterStart unmarshals when learning a
+// peer's advertised register interval.
+type routerStartMessage struct {
+	Id                               string   `json:"id"`
+	Hosts                            []string `json:"hosts"`
+	MinimumRegisterIntervalInSeconds int      `json:"minimumRegisterIntervalInSeconds"`
+	PruneThresholdInSeconds          int      `json:"pruneThresholdInSeconds"`
+}
+
+func (r *Router) startMessage() []byte {
 	host, err := vcap.LocalIP()
 	if err != nil {
 		panic(err)
 	}
-	d := vcap.RouterStart{vcap.GenerateUUID(), []string{host}}
+
+	d := routerStartMessage{
+		Id:                               r.id,
+		Hosts:                            []string{host},
+		MinimumRegisterIntervalInSeconds: int(r.config.PublishStartMessageInterval.Seconds()),
+		PruneThresholdInSeconds:          int(r.config.DropletStaleThreshold.Seconds()),
+	}
 
 	b, err := json.Marshal(d)
 	if err != nil {
 		panic(err)
 	}
 
-	// Send start message once at start
-	r.mbusClient.Publish("router.start", b)
+	return b
+}
+
+// SendStartMessage publishes a router.start announcement immediately. It is
+// called once when the router boots and again whenever the mbus connection
+// is re-established, so that peers that missed the initial announcement
+// (e.g. because NATS was unreachable) learn about this router right away
+// instead of waiting for the next periodic tick.
+func (r *Router) SendStartMessage() {
+	err := r.mbusClient.Publish("router.start", r.startMessage())
+	if err != nil {
+		log.Errorf("Error publishing to router.start: %s", err.Error())
+	}
+}
+
+func (r *Router) ScheduleStartMessage() {
+	if r.config.PublishStartMessageInterval == 0 {
+		return
+	}
 
 	go func() {
 		t := time.NewTicker(r.config.PublishStartMessageInterval)
@@ -180,10 +300,7 @@ func (r *Router) SendStartMessage() {
 			select {
 			case <-t.C:
 				log.Info("Sending start message")
-				err := r.mbusClient.Publish("router.start", b)
-				if err != nil {
-					log.Errorf("Error publishing to router.start: %s", err.Error())
-				}
+				r.SendStartMessage()
 			}
 		}
 	}()
@@ -206,14 +323,24 @@ func (router *Router) Run() {
 
 	// Kickstart sending start messages
 	router.SendStartMessage()
+	router.ScheduleStartMessage()
 
 	// Subscribe register/unregister router
 	router.SubscribeRegister()
 	router.SubscribeUnregister()
 
+	// Greet and learn the register interval of other routers
+	router.HandleGreetings()
+	router.SubscribeToRouterStart()
+
 	// Schedule flushing active app's app_id
 	router.ScheduleFlushApps()
 
+	// Start writing/streaming access log records for proxied requests, and
+	// stop the writer goroutine if Run ever returns.
+	router.accessLogger.Start()
+	defer router.accessLogger.Stop()
+
 	// Wait for one start message send interval, such that the router's registry
 	// can be populated before serving requests.
 	if router.config.PublishStartMessageInterval != 0 {
@@ -230,25 +357,155 @@ func (router *Router) Run() {
 
 	log.Infof("Listening on %s", listen.Addr())
 
-	server := proxy.Server{Handler: router.proxy}
+	router.listener = listen
+
+	proxyServer := proxy.Server{Handler: router.proxy}
+
+	if router.config.EnableSSL {
+		sslListen, err := router.listenTLS()
+		if err != nil {
+			log.Fatalf("tls.Listen: %s", err)
+		}
+
+		log.Infof("Listening for TLS on %s", sslListen.Addr())
 
-	err = server.Serve(listen)
+		router.sslListener = sslListen
+
+		go func() {
+			err := proxyServer.Serve(sslListen)
+			if err != nil {
+				log.Fatalf("proxy.Serve (tls): %s", err)
+			}
+		}()
+	}
+
+	// The plain listener always goes through the same proxy as the TLS one:
+	// whether a given request gets redirected to https is decided per
+	// route, by Proxy.ServeHTTP consulting the matched backend's
+	// registration, not by swapping the whole listener's handler.
+	err = proxyServer.Serve(listen)
 	if err != nil {
 		log.Fatalf("proxy.Serve: %s", err)
 	}
 }
 
+// listenTLS opens the TLS listener used when config.EnableSSL is set. It
+// selects a certificate via SNI when more than one domain's certificate is
+// configured. Client certificates are requested but not enforced here; a
+// route opts into requiring one via its "client_cert_required" tag, checked
+// per-request by Proxy.ServeHTTP.
+func (router *Router) listenTLS() (net.Listener, error) {
+	tlsConfig, err := router.buildTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return tls.Listen("tcp", fmt.Sprintf(":%d", router.config.SSLPort), tlsConfig)
+}
+
+func (router *Router) buildTLSConfig() (*tls.Config, error) {
+	c := router.config
+
+	defaultCert, err := tls.LoadX509KeyPair(c.SSLCertificatePath, c.SSLKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{defaultCert},
+		NextProtos:   []string{"http/1.1"},
+	}
+
+	sniCerts, err := loadSNICertificates(c.SSLSNICertificates)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sniCerts) > 0 {
+		tlsConfig.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if cert, ok := sniCerts[hello.ServerName]; ok {
+				return cert, nil
+			}
+			return &tlsConfig.Certificates[0], nil
+		}
+	}
+
+	if c.SSLCACertificatePath != "" {
+		caCert, err := ioutil.ReadFile(c.SSLCACertificatePath)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("invalid client CA certificate: %s", c.SSLCACertificatePath)
+		}
+
+		// Request a client certificate on every connection, but don't refuse
+		// the handshake when one is missing: whether a certificate is
+		// actually required depends on which route the request is for, and
+		// is enforced per-request by Proxy.ServeHTTP via the
+		// "client_cert_required" route tag.
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequestClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+func loadSNICertificates(certs []config.SSLCertificate) (map[string]*tls.Certificate, error) {
+	result := make(map[string]*tls.Certificate)
+
+	for _, c := range certs {
+		cert, err := tls.LoadX509KeyPair(c.CertificatePath, c.KeyPath)
+		if err != nil {
+			return nil, err
+		}
+		result[c.Domain] = &cert
+	}
+
+	return result, nil
+}
+
 func (r *Router) establishMBus() {
-	mbusClient, err := mbus.NewCFMessageBus("NATS")
-	r.mbusClient = mbusClient
+	mbusClient, err := NewMessageBus(r.config)
 	if err != nil {
-		panic("Could not connect to NATS")
+		panic(fmt.Sprintf("Could not create message bus: %s", err.Error()))
 	}
+	r.mbusClient = mbusClient
+	r.mbusClient.ConfigureCluster(r.config.Nats.Servers())
+
+	r.wireMBusCallbacks()
+}
+
+// wireMBusCallbacks is split out from establishMBus so tests can drive it
+// against a fake bus without going through the real NewMessageBus factory.
+func (r *Router) wireMBusCallbacks() {
+	r.mbusClient.OnConnect(func() {
+		log.Info("Connected to NATS")
+	})
+
+	r.mbusClient.OnReconnect(func() {
+		log.Warn("Reconnected to NATS, re-announcing router")
+		r.SendStartMessage()
+	})
+
+	r.mbusClient.OnClosed(r.Shutdown)
+}
 
-	host := r.config.Nats.Host
-	user := r.config.Nats.User
-	pass := r.config.Nats.Pass
-	port := r.config.Nats.Port
+// Shutdown is called when the mbus connection is closed for good. Rather
+// than silently continuing to serve routes whose registrations can no
+// longer be refreshed, it closes the proxy listener(s) so the router stops
+// accepting new requests before the process exits.
+func (r *Router) Shutdown() {
+	log.Warn("NATS connection closed, shutting down")
+
+	if r.listener != nil {
+		r.listener.Close()
+	}
+	if r.sslListener != nil {
+		r.sslListener.Close()
+	}
 
-	r.mbusClient.Configure(host, int(port), user, pass)
+	exitFunc(1)
 }
@@ -0,0 +1,175 @@
+package router
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"router/config"
+	"router/fakemessagebus"
+)
+
+func TestOnReconnectResendsStartMessage(t *testing.T) {
+	bus := fakemessagebus.NewFakeMessageBus()
+	r := &Router{config: &config.Config{}, id: "router-id", mbusClient: bus}
+	r.wireMBusCallbacks()
+
+	bus.Reconnect()
+
+	if len(bus.Published["router.start"]) != 1 {
+		t.Errorf("expected one router.start publish after reconnect, got %d", len(bus.Published["router.start"]))
+	}
+}
+
+func TestOnClosedTriggersShutdown(t *testing.T) {
+	bus := fakemessagebus.NewFakeMessageBus()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not open listener: %s", err)
+	}
+
+	exited := false
+	originalExitFunc := exitFunc
+	exitFunc = func(code int) { exited = true }
+	defer func() { exitFunc = originalExitFunc }()
+
+	r := &Router{config: &config.Config{}, mbusClient: bus, listener: listener}
+	r.wireMBusCallbacks()
+
+	bus.Close()
+
+	if !exited {
+		t.Errorf("expected OnClosed to trigger shutdown")
+	}
+
+	if _, err := net.Dial("tcp", listener.Addr().String()); err == nil {
+		t.Errorf("expected listener to be closed after shutdown")
+	}
+}
+
+func TestHandleGreetingsRespondsWithRegisterInterval(t *testing.T) {
+	bus := fakemessagebus.NewFakeMessageBus()
+	cfg := &config.Config{
+		PublishStartMessageInterval: 5 * time.Second,
+		DropletStaleThreshold:       120 * time.Second,
+	}
+
+	r := &Router{config: cfg, mbusClient: bus}
+	r.HandleGreetings()
+
+	response := bus.Request("router.greet", []byte{})
+
+	var greeting greetMessage
+	if err := json.Unmarshal(response, &greeting); err != nil {
+		t.Fatalf("could not unmarshal greet response: %s", err)
+	}
+
+	if greeting.MinimumRegisterIntervalInSeconds != 5 {
+		t.Errorf("expected minimumRegisterIntervalInSeconds to be 5, got %d", greeting.MinimumRegisterIntervalInSeconds)
+	}
+
+	if greeting.PruneThresholdInSeconds != 120 {
+		t.Errorf("expected pruneThresholdInSeconds to be 120, got %d", greeting.PruneThresholdInSeconds)
+	}
+}
+
+func TestSubscribeRegisterAddsDroplet(t *testing.T) {
+	bus := fakemessagebus.NewFakeMessageBus()
+	r := &Router{
+		config:     &config.Config{},
+		mbusClient: bus,
+		registry:   NewRegistry(&config.Config{}),
+	}
+
+	r.SubscribeRegister()
+
+	msg := registryMessage{
+		Host: "1.2.3.4",
+		Port: 1234,
+		Uris: []Uri{"test.vcap.me"},
+		Tags: map[string]string{},
+		Dea:  "dea1",
+		App:  "app1",
+	}
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatalf("could not marshal registry message: %s", err)
+	}
+
+	bus.PublishToSubscribers("router.register", payload)
+
+	if r.registry.NumUris() != 1 {
+		t.Errorf("expected registry to have 1 uri after register, got %d", r.registry.NumUris())
+	}
+}
+
+func TestSubscribeUnregisterRemovesDroplet(t *testing.T) {
+	bus := fakemessagebus.NewFakeMessageBus()
+	r := &Router{
+		config:     &config.Config{},
+		mbusClient: bus,
+		registry:   NewRegistry(&config.Config{}),
+	}
+
+	msg := registryMessage{
+		Host: "1.2.3.4",
+		Port: 1234,
+		Uris: []Uri{"test.vcap.me"},
+		Tags: map[string]string{},
+		Dea:  "dea1",
+		App:  "app1",
+	}
+	r.registry.Register(&msg)
+
+	r.SubscribeUnregister()
+
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatalf("could not marshal registry message: %s", err)
+	}
+
+	bus.PublishToSubscribers("router.unregister", payload)
+
+	if r.registry.NumUris() != 0 {
+		t.Errorf("expected registry to have 0 uris after unregister, got %d", r.registry.NumUris())
+	}
+}
+
+func TestSubscribeToRouterStartAdoptsPeerRegisterInterval(t *testing.T) {
+	bus := fakemessagebus.NewFakeMessageBus()
+	r := &Router{
+		id:         "self-router-id",
+		config:     &config.Config{},
+		mbusClient: bus,
+		registry:   NewRegistry(&config.Config{}),
+	}
+	r.SubscribeToRouterStart()
+
+	peer := &Router{
+		id:     "peer-router-id",
+		config: &config.Config{PublishStartMessageInterval: 7 * time.Second},
+	}
+
+	bus.PublishToSubscribers("router.start", peer.startMessage())
+
+	if r.registry.PruneStaleDropletsInterval() != 7*time.Second {
+		t.Errorf("expected registry to adopt a 7s prune interval, got %s", r.registry.PruneStaleDropletsInterval())
+	}
+}
+
+func TestFlushAppsPublishesActiveApps(t *testing.T) {
+	bus := fakemessagebus.NewFakeMessageBus()
+	r := &Router{
+		config:     &config.Config{},
+		mbusClient: bus,
+		registry:   NewRegistry(&config.Config{}),
+	}
+
+	r.flushApps(time.Now().Add(-time.Minute))
+
+	if len(bus.Published["router.active_apps"]) != 1 {
+		t.Errorf("expected one router.active_apps publish, got %d", len(bus.Published["router.active_apps"]))
+	}
+}